@@ -0,0 +1,433 @@
+package dynproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+)
+
+// fileConfig is the on-disk shape of a ConfigStore's backing file, in
+// either JSON or YAML (picked by the file's extension).
+type fileConfig struct {
+	Routes        map[string]string `json:"routes" yaml:"routes"`
+	AdminUsername string            `json:"adminUsername,omitempty" yaml:"adminUsername,omitempty"`
+	AdminPassword string            `json:"adminPassword,omitempty" yaml:"adminPassword,omitempty"`
+	TLSCertFile   string            `json:"tlsCertFile,omitempty" yaml:"tlsCertFile,omitempty"`
+	TLSKeyFile    string            `json:"tlsKeyFile,omitempty" yaml:"tlsKeyFile,omitempty"`
+	TLSCAFile     string            `json:"tlsCaFile,omitempty" yaml:"tlsCaFile,omitempty"`
+	UpstreamProxy string            `json:"upstreamProxy,omitempty" yaml:"upstreamProxy,omitempty"`
+}
+
+// ConfigStore is a Storage backed by a YAML or JSON file on disk. It loads
+// the route table (and, for wiring up DynProxy/HttpStore, admin credentials,
+// TLS paths and an upstream proxy URL) once at startup, then watches the
+// file with fsnotify and atomically swaps the in-memory table whenever it
+// changes, so routes can be edited by hand or deployed by config
+// management without restarting the process.
+type ConfigStore struct {
+	path string
+
+	mu     sync.RWMutex
+	cfg    fileConfig
+	routes map[string]*url.URL
+
+	watcher *fsnotify.Watcher
+	closed  chan struct{}
+}
+
+// NewConfigStore loads path and starts watching it for changes.
+func NewConfigStore(path string) (*ConfigStore, error) {
+	cs := &ConfigStore{path: path, closed: make(chan struct{})}
+	if err := cs.reload(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("dynproxy: watch config: %w", err)
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("dynproxy: watch config: %w", err)
+	}
+	cs.watcher = watcher
+	go cs.watch()
+
+	return cs, nil
+}
+
+// Close stops watching the config file. The ConfigStore remains usable as
+// a Storage of its last-loaded state; Store/Delete still write to the file,
+// but later edits made to the file by others are no longer picked up.
+func (cs *ConfigStore) Close() error {
+	close(cs.closed)
+	return cs.watcher.Close()
+}
+
+// AdminUsername, AdminPassword, TLSCertFile, TLSKeyFile, TLSCAFile and
+// UpstreamProxyURL expose the non-route settings loaded from the config
+// file, for callers wiring up DynProxy/HttpStore/ListenAndServeTLS.
+func (cs *ConfigStore) AdminUsername() string {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.cfg.AdminUsername
+}
+
+func (cs *ConfigStore) AdminPassword() string {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.cfg.AdminPassword
+}
+
+func (cs *ConfigStore) TLSCertFile() string {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.cfg.TLSCertFile
+}
+
+func (cs *ConfigStore) TLSKeyFile() string {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.cfg.TLSKeyFile
+}
+
+func (cs *ConfigStore) TLSCAFile() string {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.cfg.TLSCAFile
+}
+
+// UpstreamProxyURL parses the configured upstream proxy, if any.
+func (cs *ConfigStore) UpstreamProxyURL() (*url.URL, bool) {
+	cs.mu.RLock()
+	raw := cs.cfg.UpstreamProxy
+	cs.mu.RUnlock()
+	if raw == "" {
+		return nil, false
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, false
+	}
+	return u, true
+}
+
+func (cs *ConfigStore) Load(key string) (endpoint *url.URL, ok bool) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	endpoint, ok = cs.routes[key]
+	return
+}
+
+func (cs *ConfigStore) Store(key string, endpoint *url.URL) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.storeLocked(key, endpoint)
+	cs.persistLocked()
+}
+
+func (cs *ConfigStore) Delete(key string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.deleteLocked(key)
+	cs.persistLocked()
+}
+
+func (cs *ConfigStore) Values() map[string]*url.URL {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	values := make(map[string]*url.URL, len(cs.routes))
+	for k, v := range cs.routes {
+		values[k] = v
+	}
+	return values
+}
+
+// Stats reports route count and the config's current Fingerprint.
+func (cs *ConfigStore) Stats() map[string]interface{} {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return map[string]interface{}{
+		"routes":      len(cs.routes),
+		"fingerprint": cs.fingerprintLocked(),
+	}
+}
+
+var _ Storage = &ConfigStore{}
+var _ StatsProvider = &ConfigStore{}
+
+func (cs *ConfigStore) storeLocked(key string, endpoint *url.URL) {
+	cs.routes[key] = endpoint
+	cs.cfg.Routes[key] = endpoint.String()
+}
+
+func (cs *ConfigStore) deleteLocked(key string) {
+	delete(cs.routes, key)
+	delete(cs.cfg.Routes, key)
+}
+
+// persistLocked writes the current route table back to the config file's
+// "routes" key, leaving admin/TLS/upstream settings untouched. It persists
+// in whichever format reload() loaded the file as, since MarshalJSONPath's
+// json.Unmarshal of an existing YAML document would otherwise fail every
+// write on a YAML-backed ConfigStore. Callers must hold cs.mu.
+func (cs *ConfigStore) persistLocked() error {
+	if ext := filepath.Ext(cs.path); ext == ".yaml" || ext == ".yml" {
+		return MarshalYAMLPath(cs.path, "routes", cs.cfg.Routes)
+	}
+	return MarshalJSONPath(cs.path, "routes", cs.cfg.Routes)
+}
+
+// Fingerprint returns a hash of the currently loaded config, stable across
+// processes for the same content. It changes whenever the route table (or
+// any other config field) changes, whether via Store/Delete or a file
+// reload picked up by the watcher.
+func (cs *ConfigStore) Fingerprint() string {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.fingerprintLocked()
+}
+
+func (cs *ConfigStore) fingerprintLocked() string {
+	keys := make([]string, 0, len(cs.cfg.Routes))
+	for k := range cs.cfg.Routes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s=%s\n", k, cs.cfg.Routes[k])
+	}
+	fmt.Fprintf(h, "admin=%s:%s\n", cs.cfg.AdminUsername, cs.cfg.AdminPassword)
+	fmt.Fprintf(h, "tls=%s:%s:%s\n", cs.cfg.TLSCertFile, cs.cfg.TLSKeyFile, cs.cfg.TLSCAFile)
+	fmt.Fprintf(h, "upstream=%s\n", cs.cfg.UpstreamProxy)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// DoLockedAction applies fn to the route table only if fingerprint matches
+// the config's current Fingerprint(), giving HTTP API callers optimistic
+// concurrency control: read the fingerprint, show the user the routes,
+// then reject their edit if someone else changed the config in between.
+// fn's Storage argument mutates cs directly; changes are persisted to the
+// config file before DoLockedAction returns.
+func (cs *ConfigStore) DoLockedAction(fingerprint string, fn func(Storage) error) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if fingerprint != cs.fingerprintLocked() {
+		return fmt.Errorf("dynproxy: fingerprint mismatch, config changed since it was read")
+	}
+	if err := fn(lockedConfigStore{cs}); err != nil {
+		return err
+	}
+	return cs.persistLocked()
+}
+
+// lockedConfigStore adapts ConfigStore to Storage for use inside
+// DoLockedAction, where cs.mu is already held by the caller.
+type lockedConfigStore struct {
+	cs *ConfigStore
+}
+
+func (l lockedConfigStore) Load(key string) (*url.URL, bool) {
+	endpoint, ok := l.cs.routes[key]
+	return endpoint, ok
+}
+
+func (l lockedConfigStore) Store(key string, endpoint *url.URL) {
+	l.cs.storeLocked(key, endpoint)
+}
+
+func (l lockedConfigStore) Delete(key string) {
+	l.cs.deleteLocked(key)
+}
+
+func (l lockedConfigStore) Values() map[string]*url.URL {
+	values := make(map[string]*url.URL, len(l.cs.routes))
+	for k, v := range l.cs.routes {
+		values[k] = v
+	}
+	return values
+}
+
+var _ Storage = lockedConfigStore{}
+
+func (cs *ConfigStore) watch() {
+	for {
+		select {
+		case <-cs.closed:
+			return
+		case event, ok := <-cs.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != filepath.Clean(cs.path) {
+				continue
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			cs.reload()
+		case _, ok := <-cs.watcher.Errors:
+			if !ok {
+				return
+			}
+		}
+	}
+}
+
+// reload reads cs.path from disk and atomically swaps it in, so readers
+// never observe a partially-parsed config.
+func (cs *ConfigStore) reload() error {
+	data, err := os.ReadFile(cs.path)
+	if err != nil {
+		return fmt.Errorf("dynproxy: read config: %w", err)
+	}
+
+	var cfg fileConfig
+	if ext := filepath.Ext(cs.path); ext == ".yaml" || ext == ".yml" {
+		err = yaml.Unmarshal(data, &cfg)
+	} else {
+		err = json.Unmarshal(data, &cfg)
+	}
+	if err != nil {
+		return fmt.Errorf("dynproxy: parse config: %w", err)
+	}
+	if cfg.Routes == nil {
+		cfg.Routes = make(map[string]string)
+	}
+
+	routes := make(map[string]*url.URL, len(cfg.Routes))
+	for key, raw := range cfg.Routes {
+		endpoint, err := url.Parse(raw)
+		if err != nil {
+			return fmt.Errorf("dynproxy: parse route %q: %w", key, err)
+		}
+		routes[key] = endpoint
+	}
+
+	cs.mu.Lock()
+	cs.cfg = cfg
+	cs.routes = routes
+	cs.mu.Unlock()
+	return nil
+}
+
+var jsonPathLocks sync.Map // map[string]*sync.Mutex
+
+func lockForJSONPath(path string) *sync.Mutex {
+	mu, _ := jsonPathLocks.LoadOrStore(path, &sync.Mutex{})
+	return mu.(*sync.Mutex)
+}
+
+// UnmarshalJSONPath reads the top-level key from the JSON file at path
+// into out, without decoding the rest of the document.
+func UnmarshalJSONPath(path, key string, out interface{}) error {
+	mu := lockForJSONPath(path)
+	mu.Lock()
+	defer mu.Unlock()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	raw, ok := doc[key]
+	if !ok {
+		return fmt.Errorf("dynproxy: no %q key in %s", key, path)
+	}
+	return json.Unmarshal(raw, out)
+}
+
+// MarshalJSONPath atomically rewrites just the top-level key in the JSON
+// file at path to value, leaving the rest of the document untouched. This
+// lets callers PATCH individual route keys (or other config fields)
+// without racing a concurrent whole-file write of the same file.
+func MarshalJSONPath(path, key string, value interface{}) error {
+	mu := lockForJSONPath(path)
+	mu.Lock()
+	defer mu.Unlock()
+
+	doc := map[string]json.RawMessage{}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return fmt.Errorf("dynproxy: parse %s: %w", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	doc[key] = raw
+
+	out, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicWriteFile(path, out)
+}
+
+// MarshalYAMLPath is MarshalJSONPath's YAML equivalent: it atomically
+// rewrites just the top-level key in the YAML file at path to value, leaving
+// the rest of the document untouched.
+func MarshalYAMLPath(path, key string, value interface{}) error {
+	mu := lockForJSONPath(path)
+	mu.Lock()
+	defer mu.Unlock()
+
+	doc := map[string]interface{}{}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return fmt.Errorf("dynproxy: parse %s: %w", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	doc[key] = value
+
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return atomicWriteFile(path, out)
+}
+
+// atomicWriteFile writes data to a temp file in dir(path) and renames it
+// into place, so readers never observe a partially-written file.
+func atomicWriteFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
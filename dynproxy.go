@@ -7,6 +7,10 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
 )
 
 type directorFunc func(r *http.Request, body []byte) (*url.URL, bool)
@@ -15,17 +19,54 @@ type transformerFunc func(r io.Reader, w io.Writer)
 
 type DynProxy struct {
 	Director directorFunc
-	// Transformer transformerFunc
+
+	// Transformer rewrites the upstream response body before it reaches the
+	// client, e.g. for URL substitution or content injection. RequestTransformer
+	// does the symmetric thing for the request body before it reaches upstream.
+	// Transformer runs against the decompressed response body and its output
+	// is re-encoded using the response's original Content-Encoding.
+	// RequestTransformer runs against the request body as received; a
+	// Content-Encoding on the request is not decoded first.
+	Transformer        transformerFunc
+	RequestTransformer transformerFunc
+
+	// TLSMinVersion and TLSCipherSuites configure ListenAndServeTLS; both
+	// are optional and fall back to Go's secure TLS 1.2+ defaults.
+	TLSMinVersion   uint16
+	TLSCipherSuites []uint16
 
 	proxy *httputil.ReverseProxy
+
+	mitmCA    *CAKeyPair
+	leafCerts *leafCertCache
+
+	upstreamProxy  *url.URL
+	upstreamDialer proxy.Dialer
+
+	// AccessLogger, if set, is invoked once per proxied request with the
+	// method, host, matched route key, resolved endpoint, upstream status
+	// and duration. It is opt-in; see NewJSONAccessLogger for a ready-made
+	// implementation.
+	AccessLogger AccessLogger
+
+	storage   Storage
+	stats     *proxyStats
+	debugOnce sync.Once
 }
 
 func New(director directorFunc) *DynProxy {
 	d := &DynProxy{
 		Director: director,
+		stats:    newProxyStats(),
 	}
 	d.proxy = &httputil.ReverseProxy{
-		Director: d.proxyDirector,
+		Director:       d.proxyDirector,
+		ModifyResponse: d.modifyResponse,
+		ErrorHandler:   d.errorHandler,
+		Transport: &http.Transport{
+			Proxy:       d.upstreamProxyFunc,
+			DialContext: d.upstreamDialContext,
+		},
 	}
 	return d
 }
@@ -43,18 +84,37 @@ func storageDirector(storage Storage, extractor extractorFunc) directorFunc {
 		if !ok {
 			return nil, false
 		}
+
+		if rec, ok := accessRecordFrom(r.Context()); ok {
+			rec.key = key
+		}
+
+		// If storage can route this key through a dedicated upstream proxy,
+		// stash it on the request context for the Transport to pick up
+		if uas, ok := storage.(UpstreamAwareStorage); ok {
+			if upstream, ok := uas.LoadUpstream(key); ok {
+				*r = *r.WithContext(withUpstream(r.Context(), upstream))
+			}
+		}
+
 		return endpoint, true
 	}
 }
 
 func NewWithStorage(storage Storage, extractor extractorFunc) *DynProxy {
-	return New(storageDirector(storage, extractor))
+	d := New(storageDirector(storage, extractor))
+	d.storage = storage
+	return d
 }
 
 func (d *DynProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	if d.proxy == nil {
 		panic("") // TODO
 	}
+	if req.Method == http.MethodConnect && d.mitmCA != nil {
+		d.serveMITM(rw, req)
+		return
+	}
 	d.proxy.ServeHTTP(rw, req)
 }
 
@@ -62,7 +122,7 @@ func (d *DynProxy) ListenAndServe(addr string) {
 	if d.proxy == nil {
 		panic("") // TODO
 	}
-	http.ListenAndServe(addr, d.proxy)
+	http.ListenAndServe(addr, d)
 }
 
 func (d *DynProxy) proxyDirector(req *http.Request) {
@@ -75,6 +135,19 @@ func (d *DynProxy) proxyDirector(req *http.Request) {
 		return
 	}
 
+	// Track access-log/stats fields for this request; storageDirector fills
+	// in rec.key below, modifyResponse reads it all back once the upstream
+	// response is known
+	rec := &accessRecord{method: req.Method, host: req.Host, start: time.Now()}
+	*req = *req.WithContext(withAccessRecord(req.Context(), rec))
+
+	// Rewrite the request body before the Director/extractor ever see it, so
+	// routing decisions are made against the same bytes that reach upstream
+	if d.RequestTransformer != nil {
+		body = runTransformer(d.RequestTransformer, body)
+		req.ContentLength = int64(len(body))
+	}
+
 	// Clear request body so we know if Director rewrites it
 	req.Body = nil
 
@@ -88,6 +161,7 @@ func (d *DynProxy) proxyDirector(req *http.Request) {
 	// If Director returned an URL, rewrite the request URL
 	if target != nil {
 		rewriteRequestUrl(req, target)
+		rec.endpoint = target.String()
 	}
 
 	// Block default User-Agent header
@@ -105,6 +179,18 @@ func (d *DynProxy) abort(req *http.Request) {
 	panic(http.ErrAbortHandler)
 }
 
+// errorHandler is installed as the ReverseProxy's ErrorHandler. Without it,
+// RoundTrip failures (the single most common real-world proxy failure: dial
+// refused, timeout, TLS handshake error) fall back to ReverseProxy's default
+// handler, which writes a bare 502 and returns without ever calling
+// ModifyResponse -- so logAccess never runs and the failure is invisible to
+// AccessLogger and proxyStats. Route it through the same accessRecord path
+// with a synthetic 502 before writing the response.
+func (d *DynProxy) errorHandler(rw http.ResponseWriter, req *http.Request, err error) {
+	d.logAccess(&http.Response{Request: req, StatusCode: http.StatusBadGateway})
+	rw.WriteHeader(http.StatusBadGateway)
+}
+
 var _ http.Handler = &DynProxy{}
 
 func readBody(b io.ReadCloser) ([]byte, error) {
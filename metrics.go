@@ -0,0 +1,258 @@
+package dynproxy
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StatsProvider is implemented by Storage backends (and DynProxy itself)
+// that can report their own observability stats, following the pattern
+// rqlite's http service uses for its /status endpoint. The returned map is
+// meant to be marshaled as-is, e.g. via expvar or encoding/json.
+type StatsProvider interface {
+	Stats() map[string]interface{}
+}
+
+// latencyBucketBoundsMs are the upper bounds (in milliseconds) of the
+// upstream-latency histogram buckets; the last bucket is unbounded.
+var latencyBucketBoundsMs = []float64{10, 50, 100, 500, 1000}
+
+// proxyStats accumulates the counters backing DynProxy.Stats(): request and
+// 5xx counts, per-key hit counts, and an upstream latency histogram.
+type proxyStats struct {
+	requests    uint64
+	upstream5xx uint64
+
+	mu      sync.Mutex
+	keyHits map[string]uint64
+	buckets []uint64 // parallel to latencyBucketBoundsMs, plus one +Inf bucket
+}
+
+func newProxyStats() *proxyStats {
+	return &proxyStats{
+		keyHits: make(map[string]uint64),
+		buckets: make([]uint64, len(latencyBucketBoundsMs)+1),
+	}
+}
+
+func (s *proxyStats) record(key string, status int, dur time.Duration) {
+	atomic.AddUint64(&s.requests, 1)
+	if status >= 500 {
+		atomic.AddUint64(&s.upstream5xx, 1)
+	}
+
+	ms := float64(dur) / float64(time.Millisecond)
+	bucket := len(latencyBucketBoundsMs)
+	for i, bound := range latencyBucketBoundsMs {
+		if ms <= bound {
+			bucket = i
+			break
+		}
+	}
+
+	s.mu.Lock()
+	s.buckets[bucket]++
+	if key != "" {
+		s.keyHits[key]++
+	}
+	s.mu.Unlock()
+}
+
+func (s *proxyStats) snapshot() map[string]interface{} {
+	requests := atomic.LoadUint64(&s.requests)
+	upstream5xx := atomic.LoadUint64(&s.upstream5xx)
+
+	var rate float64
+	if requests > 0 {
+		rate = float64(upstream5xx) / float64(requests)
+	}
+
+	s.mu.Lock()
+	keyHits := make(map[string]uint64, len(s.keyHits))
+	for k, v := range s.keyHits {
+		keyHits[k] = v
+	}
+	histogram := make(map[string]uint64, len(s.buckets))
+	for i, count := range s.buckets {
+		label := "+Inf"
+		if i < len(latencyBucketBoundsMs) {
+			label = fmt.Sprintf("%g", latencyBucketBoundsMs[i])
+		}
+		histogram[label] = count
+	}
+	s.mu.Unlock()
+
+	return map[string]interface{}{
+		"requests":          requests,
+		"upstream_5xx":      upstream5xx,
+		"upstream_5xx_rate": rate,
+		"key_hits":          keyHits,
+		"latency_ms":        histogram,
+	}
+}
+
+// Stats reports DynProxy's own request counters (total requests, 5xx rate,
+// per-key hit counts, upstream latency histogram), merged with the
+// underlying Storage's Stats() if it was created via NewWithStorage and the
+// Storage implements StatsProvider.
+func (d *DynProxy) Stats() map[string]interface{} {
+	stats := d.stats.snapshot()
+	if sp, ok := d.storage.(StatsProvider); ok {
+		stats["storage"] = sp.Stats()
+	}
+	return stats
+}
+
+// EnableDebugEndpoints mounts net/http/pprof's profiling handlers and an
+// expvar-backed /debug/vars on mux, publishing d.Stats() under it. It is
+// opt-in because pprof/expvar leak information about the running process
+// and should usually sit behind the admin API's own auth, not the public
+// proxy listener.
+func (d *DynProxy) EnableDebugEndpoints(mux *http.ServeMux) {
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	d.debugOnce.Do(func() {
+		expvar.Publish(fmt.Sprintf("dynproxy_%p", d), expvar.Func(func() interface{} {
+			return d.Stats()
+		}))
+	})
+}
+
+// AccessLogEntry describes one proxied request, passed to AccessLogger
+// after the upstream response (or failure) is known.
+type AccessLogEntry struct {
+	Time     time.Time     `json:"-"`
+	Method   string        `json:"method"`
+	Host     string        `json:"host"`
+	Key      string        `json:"key,omitempty"`
+	Endpoint string        `json:"endpoint,omitempty"`
+	Status   int           `json:"status"`
+	Duration time.Duration `json:"-"`
+}
+
+// accessLogEntryJSON is AccessLogEntry's wire shape: Time/Duration are
+// rendered as an RFC3339 timestamp and a millisecond float respectively,
+// rather than Go's default (nanosecond int) encoding of time.Duration.
+type accessLogEntryJSON struct {
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	Host       string    `json:"host"`
+	Key        string    `json:"key,omitempty"`
+	Endpoint   string    `json:"endpoint,omitempty"`
+	Status     int       `json:"status"`
+	DurationMs float64   `json:"duration_ms"`
+}
+
+func (e AccessLogEntry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(accessLogEntryJSON{
+		Time:       e.Time,
+		Method:     e.Method,
+		Host:       e.Host,
+		Key:        e.Key,
+		Endpoint:   e.Endpoint,
+		Status:     e.Status,
+		DurationMs: float64(e.Duration) / float64(time.Millisecond),
+	})
+}
+
+// AccessLogger receives one entry per proxied request. DynProxy.AccessLogger
+// is nil by default, i.e. access logging is opt-in.
+type AccessLogger interface {
+	LogAccess(entry AccessLogEntry)
+}
+
+// JSONAccessLogger is the default AccessLogger: one JSON object per line,
+// ready to ship to Loki/ELK without additional parsing.
+type JSONAccessLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONAccessLogger returns a JSONAccessLogger writing to w.
+func NewJSONAccessLogger(w io.Writer) *JSONAccessLogger {
+	return &JSONAccessLogger{w: w}
+}
+
+func (l *JSONAccessLogger) LogAccess(entry AccessLogEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(data)
+	l.w.Write([]byte("\n"))
+}
+
+var _ AccessLogger = &JSONAccessLogger{}
+
+// accessCtxKey is the context key under which proxyDirector stashes the
+// *accessRecord for a request, so storageDirector and modifyResponse can
+// fill in/read back the fields they're each responsible for.
+type accessCtxKey struct{}
+
+// accessRecord tracks the fields of an in-flight request needed for
+// AccessLogEntry and proxyStats once the response comes back. It is stored
+// as a pointer in the request context so later stages can mutate it in
+// place instead of threading values through directorFunc's return values.
+type accessRecord struct {
+	method   string
+	host     string
+	key      string
+	endpoint string
+	start    time.Time
+	logged   bool
+}
+
+func withAccessRecord(ctx context.Context, rec *accessRecord) context.Context {
+	return context.WithValue(ctx, accessCtxKey{}, rec)
+}
+
+func accessRecordFrom(ctx context.Context) (*accessRecord, bool) {
+	rec, ok := ctx.Value(accessCtxKey{}).(*accessRecord)
+	return rec, ok
+}
+
+// logAccess records proxyStats and, if d.AccessLogger is set, an
+// AccessLogEntry for the request that produced resp. It is a no-op if
+// proxyDirector never got far enough to attach an accessRecord (e.g. the
+// request was aborted before a response came back), or if the record was
+// already logged once -- modifyResponse logs the real response, and if it
+// then returns an error (e.g. a body-transform failure) ReverseProxy also
+// invokes errorHandler, which must not record the same request twice.
+func (d *DynProxy) logAccess(resp *http.Response) {
+	rec, ok := accessRecordFrom(resp.Request.Context())
+	if !ok || rec.logged {
+		return
+	}
+	rec.logged = true
+
+	duration := time.Since(rec.start)
+	d.stats.record(rec.key, resp.StatusCode, duration)
+
+	if d.AccessLogger == nil {
+		return
+	}
+	d.AccessLogger.LogAccess(AccessLogEntry{
+		Time:     rec.start,
+		Method:   rec.method,
+		Host:     rec.host,
+		Key:      rec.key,
+		Endpoint: rec.endpoint,
+		Status:   resp.StatusCode,
+		Duration: duration,
+	})
+}
@@ -0,0 +1,291 @@
+package dynproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CAKeyPair is the certificate authority DynProxy uses to mint leaf
+// certificates on the fly when MITM interception is enabled.
+type CAKeyPair struct {
+	Certificate *x509.Certificate
+	PrivateKey  *rsa.PrivateKey
+}
+
+// GenerateCACerts creates a fresh, self-signed CA suitable for passing to
+// DynProxy.EnableMITM. Clients must be configured to trust the returned
+// certificate for interception to work without warnings.
+func GenerateCACerts() (*CAKeyPair, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("dynproxy: generate ca key: %w", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dynproxy MITM CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("dynproxy: create ca cert: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CAKeyPair{Certificate: cert, PrivateKey: key}, nil
+}
+
+// LoadCACerts parses a PEM-encoded CA certificate and its PEM-encoded
+// PKCS#1 RSA private key. Keys in PKCS#8 form are not accepted.
+func LoadCACerts(certPEM, keyPEM []byte) (*CAKeyPair, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, fmt.Errorf("dynproxy: no certificate found in PEM")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, fmt.Errorf("dynproxy: no private key found in PEM")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CAKeyPair{Certificate: cert, PrivateKey: key}, nil
+}
+
+// generateLeafCert mints a short-lived leaf certificate for host, signed by
+// ca, to present during the TLS handshake with an intercepted client.
+func generateLeafCert(ca *CAKeyPair, host string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Certificate, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.Certificate.Raw},
+		PrivateKey:  key,
+	}, nil
+}
+
+// leafCertCache is an LRU cache of generated leaf certificates keyed by
+// host, so repeated CONNECTs to the same site don't pay for a fresh keypair
+// and signature every time. order is kept from least- to most-recently-used;
+// get moves a hit to the most-recently-used end so a host that's still in
+// active use is never evicted ahead of one that's merely been seen more
+// times.
+type leafCertCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    []string
+	certs    map[string]*tls.Certificate
+}
+
+func newLeafCertCache(capacity int) *leafCertCache {
+	return &leafCertCache{
+		capacity: capacity,
+		certs:    make(map[string]*tls.Certificate),
+	}
+}
+
+func (c *leafCertCache) get(host string) (*tls.Certificate, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cert, ok := c.certs[host]
+	if ok {
+		c.touch(host)
+	}
+	return cert, ok
+}
+
+func (c *leafCertCache) put(host string, cert *tls.Certificate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.certs[host]; !exists {
+		if len(c.order) >= c.capacity {
+			var evict string
+			evict, c.order = c.order[0], c.order[1:]
+			delete(c.certs, evict)
+		}
+		c.order = append(c.order, host)
+	} else {
+		c.touch(host)
+	}
+	c.certs[host] = cert
+}
+
+// touch moves host to the most-recently-used end of c.order. Callers must
+// hold c.mu and have already verified host is present in c.order.
+func (c *leafCertCache) touch(host string) {
+	for i, h := range c.order {
+		if h == host {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+	c.order = append(c.order, host)
+}
+
+// EnableMITM turns on interception mode: CONNECT requests are terminated
+// locally using leaf certificates minted from ca, and the decrypted HTTPS
+// traffic is run back through the ordinary Director so route rewriting
+// works for HTTPS the same way it does for plaintext HTTP.
+func (d *DynProxy) EnableMITM(ca *CAKeyPair) {
+	d.mitmCA = ca
+	d.leafCerts = newLeafCertCache(256)
+}
+
+func (d *DynProxy) serveMITM(rw http.ResponseWriter, req *http.Request) {
+	host := req.URL.Hostname()
+
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		http.Error(rw, "dynproxy: connection does not support hijacking", http.StatusInternalServerError)
+		return
+	}
+	clientConn, _, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		clientConn.Close()
+		return
+	}
+
+	tlsConfig := &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			sni := hello.ServerName
+			if sni == "" {
+				sni = host
+			}
+			return d.leafCertFor(sni)
+		},
+	}
+
+	tlsConn := tls.Server(clientConn, tlsConfig)
+
+	// http.Serve's accept loop calls Accept() again once it's done with the
+	// connection it got; a singleConnListener only ever hands out one and
+	// then blocks forever on l.done, leaking the goroutine running this
+	// http.Serve call unless something closes the listener. Closing the
+	// listener when the connection itself closes (keep-alive exhausted,
+	// client hangs up, etc.) makes that Accept() return io.EOF and the
+	// goroutine exit.
+	listener := newSingleConnListener(nil)
+	listener.conn = closeNotifyConn{Conn: tlsConn, onClose: listener.Close}
+	http.Serve(listener, d.proxy)
+}
+
+func (d *DynProxy) leafCertFor(host string) (*tls.Certificate, error) {
+	if cert, ok := d.leafCerts.get(host); ok {
+		return cert, nil
+	}
+	cert, err := generateLeafCert(d.mitmCA, host)
+	if err != nil {
+		return nil, err
+	}
+	d.leafCerts.put(host, cert)
+	return cert, nil
+}
+
+// singleConnListener adapts a single already-accepted net.Conn (here, the
+// hijacked+TLS-wrapped client connection) to the net.Listener interface so
+// it can be served with the stdlib's ordinary http.Serve/ReverseProxy path.
+type singleConnListener struct {
+	conn net.Conn
+	once sync.Once
+	done chan struct{}
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	return &singleConnListener{conn: conn, done: make(chan struct{})}
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.once.Do(func() { conn = l.conn })
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.done
+	return nil, io.EOF
+}
+
+func (l *singleConnListener) Close() error {
+	select {
+	case <-l.done:
+	default:
+		close(l.done)
+	}
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// closeNotifyConn wraps a net.Conn to invoke onClose whenever Close is
+// called, so a singleConnListener can be torn down as soon as the connection
+// it was built around actually closes.
+type closeNotifyConn struct {
+	net.Conn
+	onClose func() error
+}
+
+func (c closeNotifyConn) Close() error {
+	err := c.Conn.Close()
+	c.onClose()
+	return err
+}
@@ -0,0 +1,361 @@
+package dynproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+)
+
+// raftCommand is the payload applied to the replicated log for a single
+// route mutation.
+type raftCommand struct {
+	Op       string `json:"op"` // "store" or "delete"
+	Key      string `json:"key"`
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+// raftFSM is the raft.FSM backing a RaftStore: an in-memory routing table
+// rebuilt by replaying raftCommand log entries.
+type raftFSM struct {
+	mu sync.RWMutex
+	m  map[string]*url.URL
+}
+
+func newRaftFSM() *raftFSM {
+	return &raftFSM{m: make(map[string]*url.URL)}
+}
+
+func (f *raftFSM) Apply(log *raft.Log) interface{} {
+	var cmd raftCommand
+	if err := json.Unmarshal(log.Data, &cmd); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch cmd.Op {
+	case "store":
+		endpoint, err := url.Parse(cmd.Endpoint)
+		if err != nil {
+			return err
+		}
+		f.m[cmd.Key] = endpoint
+	case "delete":
+		delete(f.m, cmd.Key)
+	default:
+		return fmt.Errorf("raftstore: unknown op %q", cmd.Op)
+	}
+	return nil
+}
+
+func (f *raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	values := make(map[string]string, len(f.m))
+	for k, v := range f.m {
+		values[k] = v.String()
+	}
+	return &raftFSMSnapshot{values}, nil
+}
+
+func (f *raftFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	var values map[string]string
+	if err := json.NewDecoder(rc).Decode(&values); err != nil {
+		return err
+	}
+
+	m := make(map[string]*url.URL, len(values))
+	for k, v := range values {
+		endpoint, err := url.Parse(v)
+		if err != nil {
+			return err
+		}
+		m[k] = endpoint
+	}
+
+	f.mu.Lock()
+	f.m = m
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *raftFSM) Load(key string) (endpoint *url.URL, ok bool) {
+	f.mu.RLock()
+	endpoint, ok = f.m[key]
+	f.mu.RUnlock()
+	return
+}
+
+func (f *raftFSM) Values() map[string]*url.URL {
+	copy := make(map[string]*url.URL)
+	f.mu.RLock()
+	for k, v := range f.m {
+		copy[k] = v
+	}
+	f.mu.RUnlock()
+	return copy
+}
+
+// raftFSMSnapshot persists the FSM's map as JSON so the replicated log can
+// be truncated once a snapshot covers it.
+type raftFSMSnapshot struct {
+	values map[string]string
+}
+
+func (s *raftFSMSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s.values); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *raftFSMSnapshot) Release() {}
+
+// RaftStore is a Storage implementation whose routing table is replicated
+// across a cluster of dynproxy instances via hashicorp/raft, so a PUT/DELETE
+// applied on the leader is durably reflected on every follower without
+// operators having to sync SQLite files by hand.
+//
+// A follower forwards PUT/DELETE to the leader over plain HTTP (see
+// forwardToLeader), which cannot carry the client-cert identity a follower's
+// TLS termination established. Wrapping a RaftStore in an HttpStore with an
+// ACL configured (see HttpStore.SetACL) is therefore only safe against a
+// single-node "cluster", or if every write happens to land on the leader
+// already; ServeHTTP otherwise fails those requests with 501 rather than
+// forwarding them to be silently denied.
+type RaftStore struct {
+	raft *raft.Raft
+	fsm  *raftFSM
+
+	mu        sync.RWMutex
+	httpAddrs map[raft.ServerID]string
+
+	ApplyTimeout time.Duration
+}
+
+// NewRaftStore starts a Raft node identified by nodeID, listening for
+// cluster traffic on raftAddr and persisting its log/snapshots under
+// dataDir. When bootstrap is true the node forms a brand new single-node
+// cluster; otherwise it is expected to be added to an existing cluster via
+// the leader's Join handler.
+func NewRaftStore(nodeID, raftAddr, dataDir string, bootstrap bool) (*RaftStore, error) {
+	fsm := newRaftFSM()
+
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(nodeID)
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", raftAddr)
+	if err != nil {
+		return nil, fmt.Errorf("raftstore: resolve addr: %w", err)
+	}
+	transport, err := raft.NewTCPTransport(raftAddr, tcpAddr, 3, 10*time.Second, io.Discard)
+	if err != nil {
+		return nil, fmt.Errorf("raftstore: transport: %w", err)
+	}
+
+	snapshots, err := raft.NewFileSnapshotStore(dataDir, 2, io.Discard)
+	if err != nil {
+		return nil, fmt.Errorf("raftstore: snapshot store: %w", err)
+	}
+
+	// Log and stable store must persist to the same dataDir as the snapshot
+	// store: an in-memory store loses the log and the last persisted
+	// term/vote on every restart, which both violates Raft's safety
+	// invariants and leaves old on-disk snapshots pointing at log indices
+	// that no longer exist.
+	boltStore, err := raftboltdb.NewBoltStore(filepath.Join(dataDir, "raft.db"))
+	if err != nil {
+		return nil, fmt.Errorf("raftstore: bolt store: %w", err)
+	}
+
+	r, err := raft.NewRaft(config, fsm, boltStore, boltStore, snapshots, transport)
+	if err != nil {
+		return nil, fmt.Errorf("raftstore: new raft: %w", err)
+	}
+
+	if bootstrap {
+		r.BootstrapCluster(raft.Configuration{
+			Servers: []raft.Server{
+				{ID: config.LocalID, Address: transport.LocalAddr()},
+			},
+		})
+	}
+
+	return &RaftStore{
+		raft:         r,
+		fsm:          fsm,
+		httpAddrs:    make(map[raft.ServerID]string),
+		ApplyTimeout: 10 * time.Second,
+	}, nil
+}
+
+func (rs *RaftStore) Load(key string) (*url.URL, bool) {
+	return rs.fsm.Load(key)
+}
+
+func (rs *RaftStore) Values() map[string]*url.URL {
+	return rs.fsm.Values()
+}
+
+func (rs *RaftStore) Store(key string, endpoint *url.URL) {
+	rs.apply(raftCommand{Op: "store", Key: key, Endpoint: endpoint.String()})
+}
+
+func (rs *RaftStore) Delete(key string) {
+	rs.apply(raftCommand{Op: "delete", Key: key})
+}
+
+func (rs *RaftStore) apply(cmd raftCommand) error {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	future := rs.raft.Apply(data, rs.ApplyTimeout)
+	return future.Error()
+}
+
+// IsLeader reports whether this node currently holds Raft leadership.
+func (rs *RaftStore) IsLeader() bool {
+	return rs.raft.State() == raft.Leader
+}
+
+// Stats reports route count, leadership state, and the underlying Raft
+// node's own stats (log index, term, peer counts, etc).
+func (rs *RaftStore) Stats() map[string]interface{} {
+	return map[string]interface{}{
+		"routes":    len(rs.Values()),
+		"is_leader": rs.IsLeader(),
+		"raft":      rs.raft.Stats(),
+	}
+}
+
+// LeaderHTTPAddr returns the admin HTTP address the current leader
+// registered when it joined the cluster, or "" if it is not yet known.
+func (rs *RaftStore) LeaderHTTPAddr() string {
+	_, id := rs.raft.LeaderWithID()
+
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	return rs.httpAddrs[id]
+}
+
+// Join adds a voter to the cluster. It must be called against the leader;
+// raft itself returns raft.ErrNotLeader otherwise.
+func (rs *RaftStore) Join(nodeID, raftAddr, httpAddr string) error {
+	future := rs.raft.AddVoter(raft.ServerID(nodeID), raft.ServerAddress(raftAddr), 0, 0)
+	if err := future.Error(); err != nil {
+		return err
+	}
+
+	rs.mu.Lock()
+	rs.httpAddrs[raft.ServerID(nodeID)] = httpAddr
+	rs.mu.Unlock()
+	return nil
+}
+
+// Remove removes a server from the cluster, e.g. when decommissioning a node.
+func (rs *RaftStore) Remove(nodeID string) error {
+	future := rs.raft.RemoveServer(raft.ServerID(nodeID), 0, 0)
+	if err := future.Error(); err != nil {
+		return err
+	}
+
+	rs.mu.Lock()
+	delete(rs.httpAddrs, raft.ServerID(nodeID))
+	rs.mu.Unlock()
+	return nil
+}
+
+var _ Storage = &RaftStore{}
+var _ StatsProvider = &RaftStore{}
+
+// RaftJoinHandler is an http.Handler exposing the cluster membership
+// operations needed to grow or shrink a RaftStore's cluster: POST to join a
+// node, DELETE to remove one.
+type RaftJoinHandler struct {
+	store *RaftStore
+}
+
+func NewRaftJoinHandler(store *RaftStore) *RaftJoinHandler {
+	return &RaftJoinHandler{store}
+}
+
+func (h *RaftJoinHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	nodeID := req.Form.Get("id")
+	raftAddr := req.Form.Get("raftAddr")
+	httpAddr := req.Form.Get("httpAddr")
+	if nodeID == "" || (req.Method == "POST" && (raftAddr == "" || httpAddr == "")) {
+		http.Error(rw, "missing id/raftAddr/httpAddr", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	switch req.Method {
+	case "POST":
+		err = h.store.Join(nodeID, raftAddr, httpAddr)
+	case "DELETE":
+		err = h.store.Remove(nodeID)
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+var _ http.Handler = &RaftJoinHandler{}
+
+// forwardToLeader proxies req to the current Raft leader's admin HTTP
+// endpoint so that PUT/DELETE requests landing on a follower still succeed.
+func forwardToLeader(rw http.ResponseWriter, req *http.Request, leaderAddr string) {
+	target := *req.URL
+	target.Scheme = "http"
+	target.Host = leaderAddr
+
+	fwd, err := http.NewRequest(req.Method, target.String(), strings.NewReader(req.Form.Encode()))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fwd.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// Carry over the caller's Basic Auth credentials, or the leader will
+	// reject the forwarded request with 401 when HttpStore has auth
+	// configured. There's no equivalent for TLS client-cert ACLs: the
+	// principal is derived from req.TLS on whichever node terminates TLS,
+	// and that identity can't be proven to the leader over this plain HTTP
+	// hop without a trusted proxy header scheme.
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		fwd.Header.Set("Authorization", auth)
+	}
+
+	resp, err := http.DefaultClient.Do(fwd)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	rw.WriteHeader(resp.StatusCode)
+	io.Copy(rw, resp.Body)
+}
@@ -0,0 +1,150 @@
+package dynproxy
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// QueueConfig tunes sqliteWriteQueue's batching. Zero values fall back to
+// defaultBatchSize/defaultMaxLatency.
+type QueueConfig struct {
+	// BatchSize is the number of queued writes applied per transaction.
+	BatchSize int
+	// MaxLatency bounds how long a write can sit in the queue before being
+	// flushed even if BatchSize hasn't been reached.
+	MaxLatency time.Duration
+}
+
+const (
+	defaultBatchSize  = 128
+	defaultMaxLatency = 50 * time.Millisecond
+)
+
+// sqliteWrite is a single queued statement/args pair, applied as part of a
+// batch inside one sql.Tx.
+type sqliteWrite struct {
+	stmt string
+	args []interface{}
+}
+
+// sqliteWriteQueue batches SqliteStore writes the way rqlite's queue
+// package batches Raft log appends: callers enqueue without blocking on
+// disk, and a single background goroutine drains the channel in
+// BatchSize-sized groups (or every MaxLatency, whichever comes first) and
+// applies each group inside one sql.Tx.
+type sqliteWriteQueue struct {
+	cfg QueueConfig
+
+	writes  chan sqliteWrite
+	flushes chan chan error
+	errCh   chan error
+}
+
+func newSqliteWriteQueue(db *sql.DB, cfg QueueConfig) *sqliteWriteQueue {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultBatchSize
+	}
+	if cfg.MaxLatency <= 0 {
+		cfg.MaxLatency = defaultMaxLatency
+	}
+
+	q := &sqliteWriteQueue{
+		cfg:     cfg,
+		writes:  make(chan sqliteWrite, cfg.BatchSize*4),
+		flushes: make(chan chan error),
+		errCh:   make(chan error, 16),
+	}
+	go q.run(db)
+	return q
+}
+
+func (q *sqliteWriteQueue) enqueue(w sqliteWrite) {
+	q.writes <- w
+}
+
+// flush blocks until every write enqueued before the call returns has been
+// applied, or ctx is done.
+func (q *sqliteWriteQueue) flush(ctx context.Context) error {
+	ack := make(chan error, 1)
+	select {
+	case q.flushes <- ack:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-ack:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *sqliteWriteQueue) run(db *sql.DB) {
+	batch := make([]sqliteWrite, 0, q.cfg.BatchSize)
+	timer := time.NewTimer(q.cfg.MaxLatency)
+	defer timer.Stop()
+
+	apply := func(ack chan error) {
+		var err error
+		if len(batch) > 0 {
+			err = applySqliteBatch(db, batch)
+			batch = batch[:0]
+		}
+		if err != nil {
+			select {
+			case q.errCh <- err:
+			default:
+			}
+		}
+		if ack != nil {
+			ack <- err
+		}
+	}
+
+	for {
+		select {
+		case w := <-q.writes:
+			batch = append(batch, w)
+			if len(batch) >= q.cfg.BatchSize {
+				apply(nil)
+				timer.Reset(q.cfg.MaxLatency)
+			}
+		case <-timer.C:
+			apply(nil)
+			timer.Reset(q.cfg.MaxLatency)
+		case ack := <-q.flushes:
+			// Drain every write already sitting in the channel before
+			// applying, so a write enqueued before this flush call can't
+			// be skipped just because the select below picked the flush
+			// case over the write case.
+		drain:
+			for {
+				select {
+				case w := <-q.writes:
+					batch = append(batch, w)
+				default:
+					break drain
+				}
+			}
+			apply(ack)
+			timer.Reset(q.cfg.MaxLatency)
+		}
+	}
+}
+
+// applySqliteBatch runs every write in batch inside a single transaction,
+// rolling back on the first error.
+func applySqliteBatch(db *sql.DB, batch []sqliteWrite) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, w := range batch {
+		if _, err := tx.Exec(w.stmt, w.args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -1,12 +1,14 @@
 package dynproxy
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 type Storage interface {
@@ -19,6 +21,8 @@ type Storage interface {
 type MemoryStore struct {
 	mu sync.RWMutex
 	m  map[string]*url.URL
+
+	loads, stores, deletes uint64
 }
 
 func NewMemoryStore() *MemoryStore {
@@ -28,6 +32,7 @@ func NewMemoryStore() *MemoryStore {
 }
 
 func (ms *MemoryStore) Load(key string) (endpoint *url.URL, ok bool) {
+	atomic.AddUint64(&ms.loads, 1)
 	ms.mu.RLock()
 	endpoint, ok = ms.m[key]
 	ms.mu.RUnlock()
@@ -35,12 +40,14 @@ func (ms *MemoryStore) Load(key string) (endpoint *url.URL, ok bool) {
 }
 
 func (ms *MemoryStore) Store(key string, endpoint *url.URL) {
+	atomic.AddUint64(&ms.stores, 1)
 	ms.mu.Lock()
 	ms.m[key] = endpoint
 	ms.mu.Unlock()
 }
 
 func (ms *MemoryStore) Delete(key string) {
+	atomic.AddUint64(&ms.deletes, 1)
 	ms.mu.Lock()
 	delete(ms.m, key)
 	ms.mu.Unlock()
@@ -56,14 +63,58 @@ func (ms *MemoryStore) Values() map[string]*url.URL {
 	return copy
 }
 
+// Stats reports route count plus Load/Store/Delete call counters, for
+// publishing via DynProxy.Stats/EnableDebugEndpoints.
+func (ms *MemoryStore) Stats() map[string]interface{} {
+	ms.mu.RLock()
+	routes := len(ms.m)
+	ms.mu.RUnlock()
+	return map[string]interface{}{
+		"routes":  routes,
+		"loads":   atomic.LoadUint64(&ms.loads),
+		"stores":  atomic.LoadUint64(&ms.stores),
+		"deletes": atomic.LoadUint64(&ms.deletes),
+	}
+}
+
 var _ Storage = &MemoryStore{}
+var _ StatsProvider = &MemoryStore{}
 
 type SqliteStore struct {
 	db *sql.DB
+
+	queue *sqliteWriteQueue
+
+	loads, stores, deletes uint64
 }
 
 func NewSqliteStore(db *sql.DB) *SqliteStore {
-	return &SqliteStore{db}
+	return &SqliteStore{db: db}
+}
+
+// NewSqliteStoreWithQueue is like NewSqliteStore, but Store/Delete append to
+// an in-memory write queue instead of executing immediately; see
+// sqliteWriteQueue for the batching behavior.
+func NewSqliteStoreWithQueue(db *sql.DB, cfg QueueConfig) *SqliteStore {
+	return &SqliteStore{db: db, queue: newSqliteWriteQueue(db, cfg)}
+}
+
+// Flush blocks until every write queued so far has been applied, or ctx is
+// done. It is a no-op on a SqliteStore created without a queue.
+func (ss *SqliteStore) Flush(ctx context.Context) error {
+	if ss.queue == nil {
+		return nil
+	}
+	return ss.queue.flush(ctx)
+}
+
+// Errors returns the channel background flush failures are reported on. It
+// is nil on a SqliteStore created without a queue.
+func (ss *SqliteStore) Errors() <-chan error {
+	if ss.queue == nil {
+		return nil
+	}
+	return ss.queue.errCh
 }
 
 func (ss *SqliteStore) Init() (err error) {
@@ -78,6 +129,7 @@ func (ss *SqliteStore) Init() (err error) {
 }
 
 func (ss *SqliteStore) Load(key string) (*url.URL, bool) {
+	atomic.AddUint64(&ss.loads, 1)
 	row := ss.db.QueryRow(`SELECT endpoint FROM dynproxy WHERE key = ?;`, key)
 	var value string
 	if err := row.Scan(&value); err != nil {
@@ -91,10 +143,20 @@ func (ss *SqliteStore) Load(key string) (*url.URL, bool) {
 }
 
 func (ss *SqliteStore) Store(key string, endpoint *url.URL) {
+	atomic.AddUint64(&ss.stores, 1)
+	if ss.queue != nil {
+		ss.queue.enqueue(sqliteWrite{stmt: "INSERT INTO dynproxy (key, endpoint) VALUES (?, ?);", args: []interface{}{key, endpoint.String()}})
+		return
+	}
 	ss.db.Exec(`INSERT INTO dynproxy (key, endpoint) VALUES (?, ?);`, key, endpoint.String())
 }
 
 func (ss *SqliteStore) Delete(key string) {
+	atomic.AddUint64(&ss.deletes, 1)
+	if ss.queue != nil {
+		ss.queue.enqueue(sqliteWrite{stmt: "DELETE FROM dynproxy WHERE key = ?;", args: []interface{}{key}})
+		return
+	}
 	ss.db.Exec(`DELETE FROM dynproxy WHERE key = ?;`, key)
 }
 
@@ -118,7 +180,23 @@ func (ss *SqliteStore) Values() map[string]*url.URL {
 	return values
 }
 
+// Stats reports route count, Load/Store/Delete call counters, and (if the
+// store was created with a write queue) the queue's pending write count.
+func (ss *SqliteStore) Stats() map[string]interface{} {
+	stats := map[string]interface{}{
+		"routes":  len(ss.Values()),
+		"loads":   atomic.LoadUint64(&ss.loads),
+		"stores":  atomic.LoadUint64(&ss.stores),
+		"deletes": atomic.LoadUint64(&ss.deletes),
+	}
+	if ss.queue != nil {
+		stats["queued_writes"] = len(ss.queue.writes)
+	}
+	return stats
+}
+
 var _ Storage = &SqliteStore{}
+var _ StatsProvider = &SqliteStore{}
 
 type ReadOnlyStore struct {
 	Storage
@@ -130,13 +208,26 @@ func NewReadOnlyStore(storage Storage) *ReadOnlyStore {
 
 func (ros *ReadOnlyStore) Delete(key string) {}
 
+// Stats delegates to the wrapped Storage if it implements StatsProvider,
+// otherwise reports just the route count.
+func (ros *ReadOnlyStore) Stats() map[string]interface{} {
+	if sp, ok := ros.Storage.(StatsProvider); ok {
+		return sp.Stats()
+	}
+	return map[string]interface{}{"routes": len(ros.Values())}
+}
+
 var _ Storage = &ReadOnlyStore{}
+var _ StatsProvider = &ReadOnlyStore{}
 
 type HttpStore struct {
 	Storage
 
 	username string
 	password string
+	acl      ACL
+
+	unauthorized, forbidden uint64
 }
 
 func NewHttpStore(storage Storage) *HttpStore {
@@ -151,6 +242,20 @@ func NewHttpStoreWithAuth(storage Storage, username, password string) *HttpStore
 	}
 }
 
+// SetACL restricts which route keys a given client-certificate principal
+// (its CN or SAN, see principalFromRequest) may PUT/DELETE. It has no effect
+// unless the HttpStore is served behind TLS with client authentication,
+// e.g. via DynProxy.ListenAndServeTLS with a caFile configured.
+//
+// It is not compatible with a RaftStore-backed HttpStore that needs to
+// forward writes to the Raft leader (see RaftStore's doc comment): the
+// forward hop is plain HTTP, so the leader has no req.TLS and can't recover
+// the principal. ServeHTTP fails such requests with 501 rather than
+// forwarding them to be silently denied.
+func (hs *HttpStore) SetACL(acl ACL) {
+	hs.acl = acl
+}
+
 func (hs *HttpStore) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	if !hs.authenticate(rw, req) {
 		return
@@ -159,23 +264,65 @@ func (hs *HttpStore) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	req.ParseForm()
 	form := req.Form
 
+	if (req.Method == "PUT" || req.Method == "DELETE") && hs.needsLeaderForward() {
+		// forwardToLeader hands the request to the leader over plain HTTP,
+		// which strips req.TLS and with it any client-cert principal. Rather
+		// than forward anyway and have the leader silently deny (or only
+		// match a "*"-keyed wildcard for) every write regardless of which
+		// cert actually sent it, fail loudly so the misconfiguration is
+		// obvious. See SetACL's doc comment.
+		if hs.acl != nil {
+			http.Error(rw, "dynproxy: mTLS ACL and Raft leader-forwarding are not supported together", http.StatusNotImplemented)
+			return
+		}
+		forwardToLeader(rw, req, hs.leaderAddr())
+		return
+	}
+
 	switch req.Method {
 	case "GET":
 		hs.handleGet(rw, form)
 	case "PUT":
-		hs.handlePut(rw, form)
+		hs.handlePut(rw, principalFromRequest(req), form)
 	case "DELETE":
-		hs.handleDelete(rw, form)
+		hs.handleDelete(rw, principalFromRequest(req), form)
 	default:
 		rw.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
+// authorize reports whether principal may mutate key. It always allows the
+// request when no ACL is configured, i.e. ACLs are opt-in.
+func (hs *HttpStore) authorize(principal, key string) bool {
+	if hs.acl == nil {
+		return true
+	}
+	if allowed := hs.acl.Allowed(principal, key); !allowed {
+		atomic.AddUint64(&hs.forbidden, 1)
+		return false
+	}
+	return true
+}
+
+// needsLeaderForward reports whether hs wraps a RaftStore that is not
+// currently the Raft leader, meaning mutations must be forwarded rather
+// than applied locally.
+func (hs *HttpStore) needsLeaderForward() bool {
+	rs, ok := hs.Storage.(*RaftStore)
+	return ok && !rs.IsLeader()
+}
+
+func (hs *HttpStore) leaderAddr() string {
+	rs := hs.Storage.(*RaftStore)
+	return rs.LeaderHTTPAddr()
+}
+
 func (hs *HttpStore) authenticate(rw http.ResponseWriter, req *http.Request) bool {
 	if hs.username == "" || hs.password == "" {
 		return true
 	}
 	if user, pass, ok := req.BasicAuth(); !ok || user != hs.username || pass != hs.password {
+		atomic.AddUint64(&hs.unauthorized, 1)
 		rw.Header().Set("WWW-Authenticate", "Basic realm=\"dynproxy\"")
 		rw.WriteHeader(http.StatusUnauthorized)
 		return false
@@ -203,8 +350,12 @@ func (hs *HttpStore) handleGet(rw http.ResponseWriter, form url.Values) {
 	rw.Write([]byte(values.Encode()))
 }
 
-func (hs *HttpStore) handlePut(rw http.ResponseWriter, form url.Values) {
+func (hs *HttpStore) handlePut(rw http.ResponseWriter, principal string, form url.Values) {
 	for key := range form {
+		if !hs.authorize(principal, key) {
+			http.Error(rw, fmt.Sprintf("forbidden for: %s", key), http.StatusForbidden)
+			return
+		}
 		value := strings.TrimSpace(form.Get(key))
 		if value == "" {
 			continue
@@ -224,12 +375,30 @@ func (hs *HttpStore) handlePut(rw http.ResponseWriter, form url.Values) {
 	rw.WriteHeader(http.StatusOK)
 }
 
-func (hs *HttpStore) handleDelete(rw http.ResponseWriter, form url.Values) {
+func (hs *HttpStore) handleDelete(rw http.ResponseWriter, principal string, form url.Values) {
 	for key := range form {
+		if !hs.authorize(principal, key) {
+			http.Error(rw, fmt.Sprintf("forbidden for: %s", key), http.StatusForbidden)
+			return
+		}
 		hs.Delete(key)
 	}
 	rw.WriteHeader(http.StatusOK)
 }
 
+// Stats merges the wrapped Storage's Stats (if it implements StatsProvider)
+// with HttpStore's own auth-failure counters.
+func (hs *HttpStore) Stats() map[string]interface{} {
+	stats := map[string]interface{}{
+		"unauthorized": atomic.LoadUint64(&hs.unauthorized),
+		"forbidden":    atomic.LoadUint64(&hs.forbidden),
+	}
+	if sp, ok := hs.Storage.(StatsProvider); ok {
+		stats["storage"] = sp.Stats()
+	}
+	return stats
+}
+
 var _ Storage = &HttpStore{}
 var _ http.Handler = &HttpStore{}
+var _ StatsProvider = &HttpStore{}
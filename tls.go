@@ -0,0 +1,106 @@
+package dynproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// ACL restricts which route keys a given authenticated principal (the CN or
+// first SAN of a client certificate) may mutate through HttpStore.
+type ACL interface {
+	// Allowed reports whether principal may PUT/DELETE the given route key.
+	Allowed(principal, key string) bool
+}
+
+// MapACL is the simplest ACL: a static map from principal to the list of
+// keys it may touch, with "*" allowing every key.
+type MapACL map[string][]string
+
+func (a MapACL) Allowed(principal, key string) bool {
+	for _, k := range a[principal] {
+		if k == "*" || k == key {
+			return true
+		}
+	}
+	return false
+}
+
+var _ ACL = MapACL{}
+
+// NewServerTLSConfig builds a tls.Config for terminating TLS on the admin
+// API and proxied traffic. If caFile is non-empty, client certificates are
+// required and verified against it; otherwise the server accepts plain TLS
+// without client authentication.
+func NewServerTLSConfig(certFile, keyFile, caFile string, minVersion uint16, cipherSuites []uint16) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("dynproxy: load server cert: %w", err)
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   minVersion,
+		CipherSuites: cipherSuites,
+	}
+
+	if caFile != "" {
+		caPEM, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("dynproxy: read ca bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("dynproxy: no certificates found in %s", caFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg, nil
+}
+
+// ListenAndServeTLS terminates TLS for both the admin endpoints and the
+// proxied traffic, verifying client certificates against caFile when it is
+// non-empty.
+func (d *DynProxy) ListenAndServeTLS(addr, certFile, keyFile, caFile string) error {
+	if d.proxy == nil {
+		panic("") // TODO
+	}
+
+	minVersion := d.TLSMinVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+
+	tlsConfig, err := NewServerTLSConfig(certFile, keyFile, caFile, minVersion, d.TLSCipherSuites)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Addr:      addr,
+		Handler:   d,
+		TLSConfig: tlsConfig,
+	}
+	return server.ListenAndServeTLS("", "")
+}
+
+// principalFromRequest returns the CN of the client certificate presented on
+// req, falling back to its first DNS SAN if CN is empty, or "" if no
+// certificate was presented.
+func principalFromRequest(req *http.Request) string {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	cert := req.TLS.PeerCertificates[0]
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return ""
+}
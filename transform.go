@@ -0,0 +1,136 @@
+package dynproxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ChainTransformers composes multiple transformerFuncs into one, piping the
+// output of each into the next (e.g. URL-substitution followed by header
+// injection). Intermediate stages are buffered so each transformer still
+// sees a plain io.Reader; only the first read and the last write touch the
+// caller's r and w directly. With no transformers it copies r to w unchanged.
+func ChainTransformers(transformers ...transformerFunc) transformerFunc {
+	return func(r io.Reader, w io.Writer) {
+		if len(transformers) == 0 {
+			io.Copy(w, r)
+			return
+		}
+		cur := r
+		for _, t := range transformers[:len(transformers)-1] {
+			var buf bytes.Buffer
+			t(cur, &buf)
+			cur = &buf
+		}
+		transformers[len(transformers)-1](cur, w)
+	}
+}
+
+// runTransformer runs t over body and returns the transformed bytes. It
+// exists so callers that already hold a fully-buffered body (e.g. the
+// request path, which must buffer anyway to let the Director/extractor
+// inspect it) don't need to wire up io.Pipe themselves.
+func runTransformer(t transformerFunc, body []byte) []byte {
+	var buf bytes.Buffer
+	t(bytes.NewReader(body), &buf)
+	return buf.Bytes()
+}
+
+// modifyResponse is installed as the ReverseProxy's ModifyResponse hook. It
+// records the access log entry and proxyStats for the request, then, if
+// Transformer is set, runs it over the upstream response body, transparently
+// decoding and re-encoding gzip/deflate Content-Encoding around the
+// transform and fixing up Content-Length afterwards (or dropping it when the
+// response carries trailers, so the body can still be sent chunked with them).
+// Trailers are preserved because the body is read to completion through the
+// original resp.Body/resp.Trailer before being replaced.
+func (d *DynProxy) modifyResponse(resp *http.Response) error {
+	d.logAccess(resp)
+
+	if d.Transformer == nil {
+		return nil
+	}
+
+	encoding := strings.ToLower(resp.Header.Get("Content-Encoding"))
+
+	decoded, err := decodeBody(resp.Body, encoding)
+	if err != nil {
+		return fmt.Errorf("dynproxy: decode response body: %w", err)
+	}
+	body, err := io.ReadAll(decoded)
+	if err != nil {
+		return fmt.Errorf("dynproxy: read response body: %w", err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		return err
+	}
+
+	transformed := runTransformer(d.Transformer, body)
+
+	encoded, err := encodeBody(transformed, encoding)
+	if err != nil {
+		return fmt.Errorf("dynproxy: encode response body: %w", err)
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(encoded))
+	if len(resp.Trailer) > 0 {
+		// net/http only sends trailers after a chunked HTTP/1.1 body, and it
+		// stops chunking once a Content-Length is set
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+		return nil
+	}
+	resp.ContentLength = int64(len(encoded))
+	resp.Header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	return nil
+}
+
+// decodeBody wraps body in a reader that undoes encoding, so transformers
+// always operate on the original, uncompressed bytes.
+func decodeBody(body io.Reader, encoding string) (io.Reader, error) {
+	switch encoding {
+	case "gzip":
+		return gzip.NewReader(body)
+	case "deflate":
+		return flate.NewReader(body), nil
+	default:
+		return body, nil
+	}
+}
+
+// encodeBody re-applies encoding to data after a transformer has run.
+func encodeBody(data []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case "gzip":
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case "deflate":
+		var buf bytes.Buffer
+		w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return data, nil
+	}
+}
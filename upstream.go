@@ -0,0 +1,111 @@
+package dynproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+// UpstreamAwareStorage lets a Storage back its routes with a per-key egress
+// path in addition to the destination endpoint, so different routes can be
+// reached through different upstreams (e.g. an internal one over SOCKS5 and
+// a public one direct). LoadUpstream returns ok == false when key has no
+// override, in which case DynProxy's global upstream proxy, if any, applies.
+type UpstreamAwareStorage interface {
+	Storage
+	LoadUpstream(key string) (upstream *url.URL, ok bool)
+}
+
+type upstreamCtxKey struct{}
+
+// withUpstream attaches a per-request upstream override to ctx, read back
+// by the Transport's Proxy/DialContext funcs installed by SetUpstreamProxy.
+func withUpstream(ctx context.Context, upstream *url.URL) context.Context {
+	return context.WithValue(ctx, upstreamCtxKey{}, upstream)
+}
+
+func upstreamFromContext(ctx context.Context) (*url.URL, bool) {
+	u, ok := ctx.Value(upstreamCtxKey{}).(*url.URL)
+	return u, ok
+}
+
+// SetUpstreamProxy routes all proxied traffic through u instead of dialing
+// destinations directly. u's scheme selects the egress mechanism:
+// "http"/"https" use it as a forwarding proxy via the Transport's Proxy
+// func, "socks5" dials through it using golang.org/x/net/proxy. Routes
+// backed by an UpstreamAwareStorage override this per-key via LoadUpstream.
+func (d *DynProxy) SetUpstreamProxy(u *url.URL) error {
+	if d.proxy == nil {
+		return fmt.Errorf("dynproxy: SetUpstreamProxy called before New")
+	}
+	switch u.Scheme {
+	case "http", "https":
+		d.upstreamProxy, d.upstreamDialer = u, nil
+	case "socks5":
+		dialer, err := socks5Dialer(u)
+		if err != nil {
+			return err
+		}
+		d.upstreamProxy, d.upstreamDialer = nil, dialer
+	default:
+		return fmt.Errorf("dynproxy: unsupported upstream proxy scheme %q", u.Scheme)
+	}
+	return nil
+}
+
+// upstreamProxyFunc is installed as the Transport's Proxy func. It prefers a
+// per-request override (set by storageDirector via UpstreamAwareStorage)
+// over the globally configured upstream, and returns nil (direct) when
+// neither applies or the applicable upstream is a SOCKS5 dialer instead.
+func (d *DynProxy) upstreamProxyFunc(req *http.Request) (*url.URL, error) {
+	if override, ok := upstreamFromContext(req.Context()); ok {
+		if override.Scheme == "http" || override.Scheme == "https" {
+			return override, nil
+		}
+		return nil, nil
+	}
+	return d.upstreamProxy, nil
+}
+
+// upstreamDialContext is installed as the Transport's DialContext func. A
+// per-request override takes precedence over the globally configured dialer:
+// a SOCKS5 override is dialed through, any other override (an HTTP(S) proxy
+// handled by upstreamProxyFunc) is dialed directly. Without an override it
+// uses the global dialer, falling back to a direct dial when none is set.
+func (d *DynProxy) upstreamDialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if override, ok := upstreamFromContext(ctx); ok {
+		if override.Scheme == "socks5" {
+			dialer, err := socks5Dialer(override)
+			if err != nil {
+				return nil, err
+			}
+			return dialer.Dial(network, addr)
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	if d.upstreamDialer != nil {
+		return d.upstreamDialer.Dial(network, addr)
+	}
+	return (&net.Dialer{}).DialContext(ctx, network, addr)
+}
+
+// socks5Dialer builds a proxy.Dialer for a socks5:// upstream URL, carrying
+// over basic auth credentials if present.
+func socks5Dialer(u *url.URL) (proxy.Dialer, error) {
+	var auth *proxy.Auth
+	if u.User != nil {
+		auth = &proxy.Auth{User: u.User.Username()}
+		if pass, ok := u.User.Password(); ok {
+			auth.Password = pass
+		}
+	}
+	dialer, err := proxy.SOCKS5("tcp", u.Host, auth, proxy.Direct)
+	if err != nil {
+		return nil, fmt.Errorf("dynproxy: socks5 dialer: %w", err)
+	}
+	return dialer, nil
+}